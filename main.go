@@ -2,14 +2,15 @@ package main
 
 import (
 	"bufio"
-	"encoding/xml"
-	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"os"
 	"path"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	sh "github.com/codeskyblue/go-sh"
@@ -18,40 +19,6 @@ import (
 	flag "github.com/spf13/pflag"
 )
 
-type Testsuite struct {
-	XMLName    xml.Name `xml:"testsuite"`
-	Text       string   `xml:",chardata"`
-	Name       string   `xml:"name,attr"`
-	Tests      string   `xml:"tests,attr"`
-	Failures   string   `xml:"failures,attr"`
-	Errors     string   `xml:"errors,attr"`
-	Skipped    string   `xml:"skipped,attr"`
-	Time       string   `xml:"time,attr"`
-	Timestamp  string   `xml:"timestamp,attr"`
-	Hostname   string   `xml:"hostname,attr"`
-	Properties struct {
-		Text     string `xml:",chardata"`
-		Property []struct {
-			Text  string `xml:",chardata"`
-			Name  string `xml:"name,attr"`
-			Value string `xml:"value,attr"`
-		} `xml:"property"`
-	} `xml:"properties"`
-	Testcase []struct {
-		Text      string `xml:",chardata"`
-		Classname string `xml:"classname,attr"`
-		Name      string `xml:"name,attr"`
-		Time      string `xml:"time,attr"`
-		Failure   struct {
-			Text string `xml:",chardata"`
-			Type string `xml:"type,attr"`
-		} `xml:"failure"`
-		Skipped string `xml:"skipped"`
-	} `xml:"testcase"`
-	SystemOut string `xml:"system-out"`
-	SystemErr string `xml:"system-err"`
-}
-
 var logger = newLogger()
 
 func newLogger() *logrus.Logger {
@@ -70,67 +37,87 @@ func newLogger() *logrus.Logger {
 	return l
 }
 
-func readJunitFile(filename string) (Testsuite, error) {
-	var testsuite Testsuite
-	f, err := os.Open(filename)
+func processTestReport(testDirectory string, file os.FileInfo, format ReportFormat, logger *logrus.Entry) (string, []string, error) {
+	testcases := []string{}
+
+	logger.Info("Processing")
+	report, err := readTestReport(format, path.Join(testDirectory, file.Name()))
 	if err != nil {
-		return testsuite, fmt.Errorf("Failed to open junit file: %s", err)
+		logger.Warn("Error reading file")
+		return "", testcases, fmt.Errorf("Error reading file: %s", err.Error())
 	}
-	defer f.Close()
 
-	byteValue, err := ioutil.ReadAll(f)
+	testfile, err := report.Testfile()
 	if err != nil {
-		return testsuite, fmt.Errorf("Failed to read junit file: %s", err)
+		logger.Warn("Unable to generate testfile path")
+		return "", testcases, err
 	}
 
-	s := string(byteValue)
-	s = strings.ReplaceAll(s, "", "    ")
+	for _, testcase := range report.Testcases() {
+		l := logger.WithField("testcase", testcase.Name)
+		if testcase.Skipped {
+			l.WithField("status", "skipped").Info("Adding skipped testcase")
+			testcases = append(testcases, testcase.Name)
+			continue
+		}
 
-	if err := xml.Unmarshal([]byte(s), &testsuite); err != nil {
-		return testsuite, fmt.Errorf("Failed to marshall junit file: %s", err)
+		if testcase.Failed {
+			l.WithField("status", "failed").Info("Adding failed testcase")
+			testcases = append(testcases, testcase.Name)
+			continue
+		}
 	}
 
-	return testsuite, nil
+	return testfile, testcases, nil
 }
 
-func processJunitFile(testDirectory string, file os.FileInfo, logger *logrus.Entry) (string, []string, error) {
-	testfile := ""
-	testcases := []string{}
+// reportExtension returns the file extension test reports are expected to
+// have in the given format.
+func reportExtension(format ReportFormat) string {
+	if format == FormatJSON {
+		return ".json"
+	}
 
-	logger.Info("Processing")
-	testsuite, err := readJunitFile(path.Join(testDirectory, file.Name()))
+	return ".xml"
+}
+
+// listReportFiles returns the reports in testDirectory matching format.
+func listReportFiles(testDirectory string, format ReportFormat) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(testDirectory)
 	if err != nil {
-		logger.Warn("Error reading file")
-		return testfile, testcases, fmt.Errorf("Error reading file: %s", err.Error())
+		return nil, err
 	}
 
-	for _, property := range testsuite.Properties.Property {
-		if property.Name == "BATS_CWD" {
-			testfile = path.Join(property.Value, testsuite.Name)
+	extension := reportExtension(format)
+	validFiles := []os.FileInfo{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), extension) {
+			continue
 		}
-	}
 
-	if testfile == "" {
-		logger.Warn("Unable to generate testfile path")
-		return testfile, testcases, errors.New("Unable to generate testfile path")
+		validFiles = append(validFiles, file)
 	}
 
-	for _, testcase := range testsuite.Testcase {
-		l := logger.WithField("testcase", testcase.Name)
-		if testcase.Skipped != "" {
-			l.WithField("status", "skipped").Info("Adding skipped testcase")
-			testcases = append(testcases, testcase.Name)
-			continue
+	return validFiles, nil
+}
+
+// collectFailingCommands processes every report in validFiles and returns
+// the bats invocations needed to retry their failed/skipped testcases.
+func collectFailingCommands(testDirectory string, validFiles []os.FileInfo, format ReportFormat, logger *logrus.Entry) (map[string][][]string, error) {
+	batsCommands := map[string][][]string{}
+	for _, file := range validFiles {
+		lf := logger.WithField("file", file.Name())
+		testfile, newTests, err := processTestReport(testDirectory, file, format, lf)
+		if err != nil {
+			return nil, fmt.Errorf("Error processing file %s: %s", file.Name(), err.Error())
 		}
 
-		if testcase.Failure.Text != "" {
-			l.WithField("status", "failed").Info("Adding failed testcase")
-			testcases = append(testcases, testcase.Name)
-			continue
+		for _, test := range newTests {
+			batsCommands[file.Name()] = append(batsCommands[file.Name()], []string{test, testfile})
 		}
 	}
 
-	return testfile, testcases, nil
+	return batsCommands, nil
 }
 
 func writeSliceToFile(filename string, lines []string) error {
@@ -153,83 +140,226 @@ func writeSliceToFile(filename string, lines []string) error {
 	return nil
 }
 
-func executeBatsCommands(commandMap map[string][][]string, testDirectory string, logger *logrus.Entry) error {
-	var result error
+// batsJob is a single `bats --filter` invocation: one testcase within one
+// testfile's commandMap entry.
+type batsJob struct {
+	testfile string
+	testcase string
+	script   string
+}
+
+// buildBatsJobs flattens commandMap into a deterministically ordered slice
+// (sorted by testfile, then testcase, then script) so that --shard i/n
+// partitions identically across separate processes, since Go randomizes map
+// iteration order on every run.
+func buildBatsJobs(commandMap map[string][][]string) []batsJob {
+	jobs := []batsJob{}
 	for testfile, commands := range commandMap {
-		l := logger.WithField("testfile", testfile)
 		for _, command := range commands {
-			testcase := command[0]
+			jobs = append(jobs, batsJob{testfile: testfile, testcase: command[0], script: command[1]})
+		}
+	}
 
-			args := make([]interface{}, 0)
-			args = append(args, "--filter", escapeTestcase(testcase), command[1])
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].testfile != jobs[j].testfile {
+			return jobs[i].testfile < jobs[j].testfile
+		}
+		if jobs[i].testcase != jobs[j].testcase {
+			return jobs[i].testcase < jobs[j].testcase
+		}
+		return jobs[i].script < jobs[j].script
+	})
 
-			lc := l.WithField("testcase", testcase)
-			lc.WithField("bats", args).Info("Executing bats command")
-			startTime := time.Now()
-			if err := sh.Command("bats", args...).Run(); err != nil {
-				result = multierror.Append(result, err)
-				continue
-			}
-			endTime := time.Now()
-			runTime := endTime.Sub(startTime)
+	return jobs
+}
 
-			if err := updateTestFile(testfile, testDirectory, testcase, runTime, lc); err != nil {
-				result = multierror.Append(result, err)
-			}
+// parseShard parses a `--shard i/n` value into a zero-based index and the
+// total shard count.
+func parseShard(shard string) (int, int, error) {
+	parts := strings.SplitN(shard, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid shard %q, expected format i/n", shard)
+	}
+
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid shard index %q: %s", parts[0], err)
+	}
+
+	total, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid shard total %q: %s", parts[1], err)
+	}
+
+	if total < 1 || index < 1 || index > total {
+		return 0, 0, fmt.Errorf("Invalid shard %q, index must be between 1 and total", shard)
+	}
+
+	return index - 1, total, nil
+}
+
+// shardJobs splits jobs across shardTotal CI nodes, returning only the jobs
+// assigned to shardIndex (zero-based).
+func shardJobs(jobs []batsJob, shardIndex int, shardTotal int) []batsJob {
+	if shardTotal <= 1 {
+		return jobs
+	}
+
+	sharded := []batsJob{}
+	for i, job := range jobs {
+		if i%shardTotal == shardIndex {
+			sharded = append(sharded, job)
 		}
 	}
 
-	return result
+	return sharded
 }
 
-func updateTestFile(testfile string, testDirectory string, testcase string, runTime time.Duration, logger *logrus.Entry) error {
-	logger.Info("Updating testfile for testcase")
+// retryConfig controls how many times, and how patiently, a flaky testcase
+// is re-run before it's given up on.
+type retryConfig struct {
+	maxAttempts   int
+	backoff       time.Duration
+	backoffFactor float64
+	timeout       time.Duration
+}
 
-	filename := path.Join(testDirectory, testfile)
-	testsuite, err := readJunitFile(filename)
-	if err != nil {
-		return err
+// executeBatsCommands runs every job in commandMap across a bounded worker
+// pool of size parallelism. Writes to a given testfile's JUnit/JSON report
+// are serialized with a per-testfile mutex so concurrent passes of
+// testcases in the same file can't clobber each other's rewrite.
+func executeBatsCommands(commandMap map[string][][]string, testDirectory string, format ReportFormat, parallelism int, retry retryConfig, logger *logrus.Entry) ([]jobResult, error) {
+	if parallelism < 1 {
+		parallelism = 1
 	}
 
-	for i, t := range testsuite.Testcase {
-		if t.Name != testcase {
-			continue
-		}
+	fileLocks := map[string]*sync.Mutex{}
+	for testfile := range commandMap {
+		fileLocks[testfile] = &sync.Mutex{}
+	}
+
+	jobs := buildBatsJobs(commandMap)
+	jobCh := make(chan batsJob)
+	resultCh := make(chan jobResult, len(jobs))
+
+	var wg sync.WaitGroup
+	var resultMu sync.Mutex
+	var result error
 
-		l := logger.WithField("testcase", t.Name)
-		l.Info("Updating testcase")
-		testsuite.Testcase[i].Time = fmt.Sprintf("%v", math.Round(runTime.Seconds()))
-		testsuite.Testcase[i].Skipped = ""
-		testsuite.Testcase[i].Failure.Text = ""
-		testsuite.Testcase[i].Failure.Type = ""
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				jr, err := executeBatsJob(job, testDirectory, format, fileLocks[job.testfile], retry, logger)
+				resultCh <- jr
+				if err != nil {
+					resultMu.Lock()
+					result = multierror.Append(result, err)
+					resultMu.Unlock()
+				}
+			}
+		}()
 	}
 
-	b, err := xml.MarshalIndent(testsuite, "", "   ")
-	if err != nil {
-		return fmt.Errorf("Failed to marshal testsuite to string: %s", err.Error())
+	for _, job := range jobs {
+		jobCh <- job
 	}
+	close(jobCh)
+	wg.Wait()
+	close(resultCh)
 
-	s := strings.ReplaceAll(string(b), "&#xA;", "")
-	s = strings.ReplaceAll(s, "<failure type=\"\"></failure>", "")
-	s = strings.ReplaceAll(s, "<skipped></skipped>", "")
+	results := make([]jobResult, 0, len(jobs))
+	for r := range resultCh {
+		results = append(results, r)
+	}
 
-	output := []string{}
-	for _, line := range strings.Split(s, "\n") {
-		line = strings.TrimRight(line, " ")
-		if line == "" {
-			continue
+	return results, result
+}
+
+// executeBatsJob runs job, retrying up to retry.maxAttempts times with a
+// growing delay between attempts, until it either passes or the attempt
+// budget is exhausted. Only a passing attempt rewrites the testfile.
+func executeBatsJob(job batsJob, testDirectory string, format ReportFormat, fileLock *sync.Mutex, retry retryConfig, logger *logrus.Entry) (jobResult, error) {
+	l := logger.WithField("testfile", job.testfile).WithField("testcase", job.testcase)
+
+	args := make([]interface{}, 0)
+	args = append(args, "--filter", escapeTestcase(job.testcase), job.script)
+
+	maxAttempts := normalizeMaxAttempts(retry.maxAttempts)
+	delay := retry.backoff
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		la := l.WithField("attempt", attempt)
+
+		cmd := sh.Command("bats", args...)
+		if retry.timeout > 0 {
+			cmd = cmd.SetTimeout(retry.timeout)
+		}
+
+		la.WithField("bats", args).Info("Executing bats command")
+		startTime := time.Now()
+		err := cmd.Run()
+		runTime := time.Since(startTime)
+
+		jr := jobResult{testfile: job.testfile, testcase: job.testcase, attempts: attempt, duration: runTime}
+
+		if err == nil {
+			jr.recovered = true
+
+			fileLock.Lock()
+			defer fileLock.Unlock()
+
+			return jr, updateTestFile(job.testfile, testDirectory, job.testcase, runTime, attempt, format, la)
+		}
+
+		lastErr = err
+		la.WithField("error", err.Error()).Warn("Bats command failed")
+
+		if attempt == maxAttempts {
+			return jr, lastErr
+		}
+
+		if delay > 0 {
+			la.WithField("delay", delay).Info("Waiting before retrying")
+			time.Sleep(delay)
 		}
-		output = append(output, line)
+		delay = nextBackoffDelay(delay, retry.backoffFactor)
+	}
+
+	return jobResult{testfile: job.testfile, testcase: job.testcase, attempts: maxAttempts}, lastErr
+}
+
+// normalizeMaxAttempts clamps a configured attempt budget to at least 1, so
+// a misconfigured or zero-value retryConfig still runs each testcase once.
+func normalizeMaxAttempts(maxAttempts int) int {
+	if maxAttempts < 1 {
+		return 1
 	}
 
-	f, err := os.Create(filename)
+	return maxAttempts
+}
+
+// nextBackoffDelay grows delay by factor for the next retry attempt.
+func nextBackoffDelay(delay time.Duration, factor float64) time.Duration {
+	return time.Duration(float64(delay) * factor)
+}
+
+func updateTestFile(testfile string, testDirectory string, testcase string, runTime time.Duration, attempts int, format ReportFormat, logger *logrus.Entry) error {
+	logger.Info("Updating testfile for testcase")
+
+	filename := path.Join(testDirectory, testfile)
+	report, err := readTestReport(format, filename)
 	if err != nil {
-		return fmt.Errorf("Failed to open junit file for writing: %s", err.Error())
+		return err
 	}
-	defer f.Close()
 
-	if _, err := f.Write([]byte(strings.Join(output, "\n"))); err != nil {
-		return fmt.Errorf("Failed to write junit file: %s", err.Error())
+	l := logger.WithField("testcase", testcase)
+	l.Info("Updating testcase")
+	report.MarkPassed(testcase, runTime, attempts)
+
+	if err := report.Write(filename); err != nil {
+		return err
 	}
 
 	return nil
@@ -242,13 +372,44 @@ func escapeTestcase(testcase string) string {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		runWatch(os.Args[2:])
+		return
+	}
+
 	args := flag.NewFlagSet("bats-retry", flag.ExitOnError)
 	var execute *bool = args.Bool("execute", false, "whether to execute bats commands directly")
+	var formatFlag *string = args.String("format", string(FormatJunit), "test report format to read/write: junit, json")
+	var parallel *int = args.IntP("parallel", "p", runtime.NumCPU(), "number of bats commands to run concurrently")
+	var shard *string = args.String("shard", "", "split retries across CI nodes, as i/n (1-indexed)")
+	var maxAttempts *int = args.Int("max-attempts", 1, "number of times to attempt a failing testcase before giving up")
+	var backoff *time.Duration = args.Duration("backoff", time.Second, "initial delay between retry attempts")
+	var backoffFactor *float64 = args.Float64("backoff-factor", 2.0, "multiplier applied to --backoff after each attempt")
+	var timeout *time.Duration = args.Duration("timeout", 0, "kill a bats invocation if it runs longer than this (0 disables)")
+	var mergedReport *string = args.String("merged-report", "", "write a single consolidated post-retry report to this path")
+	var summaryJSON *string = args.String("summary-json", "", "write a machine-readable summary of the retry run to this path")
+	var reportSinks *[]string = args.StringArray("report", nil, "publish recovered flakes to a sink: stdout, jsonl://path, slack://webhook-host/path, http(s)://url (repeatable)")
 
 	args.Parse(os.Args[1:])
 	testDirectory := args.Arg(0)
 	testScript := args.Arg(1)
 
+	format := ReportFormat(*formatFlag)
+	if format != FormatJunit && format != FormatJSON {
+		logger.WithField("format", *formatFlag).Error("Unsupported report format")
+		os.Exit(1)
+	}
+
+	shardIndex, shardTotal := 0, 1
+	if *shard != "" {
+		var err error
+		shardIndex, shardTotal, err = parseShard(*shard)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Invalid --shard value")
+			os.Exit(1)
+		}
+	}
+
 	if testDirectory == "" {
 		logger.Error("No test directory specified")
 		os.Exit(1)
@@ -260,46 +421,83 @@ func main() {
 	}
 
 	l := logger.WithField("test-directory", testDirectory)
-	files, err := ioutil.ReadDir(testDirectory)
+	validFiles, err := listReportFiles(testDirectory, format)
 	if err != nil {
 		l.WithField("error", err.Error()).Error("Error reading test directory")
 		os.Exit(1)
 	}
 
-	validFiles := []os.FileInfo{}
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".xml") {
-			continue
-		}
-
-		validFiles = append(validFiles, file)
-	}
-
 	if len(validFiles) == 0 {
 		l.Info("No testsuites found")
 		os.Exit(0)
 	}
 
+	batsCommands, err := collectFailingCommands(testDirectory, validFiles, format, l)
+	if err != nil {
+		l.WithField("error", err.Error()).Error("Error processing file")
+		os.Exit(1)
+	}
+
+	jobs := shardJobs(buildBatsJobs(batsCommands), shardIndex, shardTotal)
+	batsCommands = map[string][][]string{}
 	lines := []string{"#!/usr/bin/env bash", "set -eo pipefail", ""}
-	batsCommands := map[string][][]string{}
-	for _, file := range validFiles {
-		lf := l.WithField("file", file.Name())
-		testfile, newTests, err := processJunitFile(testDirectory, file, lf)
-		if err != nil {
-			lf.WithField("error", err.Error()).Error("Error processing file")
-			os.Exit(1)
+	for _, job := range jobs {
+		lines = append(lines, fmt.Sprintf("bats --filter '%s' %s", escapeTestcase(job.testcase), job.script))
+		batsCommands[job.testfile] = append(batsCommands[job.testfile], []string{job.testcase, job.script})
+	}
+
+	if *execute {
+		retry := retryConfig{
+			maxAttempts:   *maxAttempts,
+			backoff:       *backoff,
+			backoffFactor: *backoffFactor,
+			timeout:       *timeout,
 		}
+		results, execErr := executeBatsCommands(batsCommands, testDirectory, format, *parallel, retry, l)
 
-		batsCommands[file.Name()] = [][]string{}
-		for _, test := range newTests {
-			lines = append(lines, fmt.Sprintf("bats --filter '%s' %s", escapeTestcase(test), testfile))
-			batsCommands[file.Name()] = append(batsCommands[file.Name()], []string{test, testfile})
+		if *summaryJSON != "" {
+			if err := writeSummaryJSON(*summaryJSON, buildSummary(results)); err != nil {
+				l.WithField("error", err.Error()).Error("Error writing summary json")
+				os.Exit(1)
+			}
 		}
-	}
 
-	if *execute {
-		if err := executeBatsCommands(batsCommands, testDirectory, l); err != nil {
-			l.WithField("error", err.Error()).Error("Error executing bats commands")
+		if *mergedReport != "" {
+			reportFiles := make([]string, 0, len(validFiles))
+			for _, file := range validFiles {
+				reportFiles = append(reportFiles, path.Join(testDirectory, file.Name()))
+			}
+
+			if err := writeMergedReport(format, reportFiles, *mergedReport); err != nil {
+				l.WithField("error", err.Error()).Error("Error writing merged report")
+				os.Exit(1)
+			}
+		}
+
+		if len(*reportSinks) > 0 {
+			flakes := []TestcaseSummary{}
+			for _, testcase := range buildSummary(results).Testcases {
+				if testcase.Recovered {
+					flakes = append(flakes, testcase)
+				}
+			}
+
+			for _, spec := range *reportSinks {
+				reporter, err := newReporter(spec)
+				if err != nil {
+					l.WithField("error", err.Error()).Error("Invalid --report value")
+					os.Exit(1)
+				}
+
+				if err := reporter.Report(flakes); err != nil {
+					l.WithField("report", spec).WithField("error", err.Error()).Error("Error publishing flake report")
+					os.Exit(1)
+				}
+			}
+		}
+
+		if execErr != nil {
+			l.WithField("error", execErr.Error()).Error("Error executing bats commands")
 			os.Exit(1)
 		}
 		os.Exit(0)
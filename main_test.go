@@ -0,0 +1,147 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseShard(t *testing.T) {
+	cases := []struct {
+		shard       string
+		wantIndex   int
+		wantTotal   int
+		expectError bool
+	}{
+		{shard: "1/3", wantIndex: 0, wantTotal: 3},
+		{shard: "3/3", wantIndex: 2, wantTotal: 3},
+		{shard: "1/1", wantIndex: 0, wantTotal: 1},
+		{shard: "0/3", expectError: true},
+		{shard: "4/3", expectError: true},
+		{shard: "3", expectError: true},
+		{shard: "a/3", expectError: true},
+		{shard: "1/a", expectError: true},
+	}
+
+	for _, c := range cases {
+		index, total, err := parseShard(c.shard)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("parseShard(%q): expected error, got none", c.shard)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseShard(%q): unexpected error: %s", c.shard, err)
+			continue
+		}
+
+		if index != c.wantIndex || total != c.wantTotal {
+			t.Errorf("parseShard(%q) = %d, %d; want %d, %d", c.shard, index, total, c.wantIndex, c.wantTotal)
+		}
+	}
+}
+
+func TestNormalizeMaxAttempts(t *testing.T) {
+	cases := []struct {
+		maxAttempts int
+		want        int
+	}{
+		{maxAttempts: 5, want: 5},
+		{maxAttempts: 1, want: 1},
+		{maxAttempts: 0, want: 1},
+		{maxAttempts: -3, want: 1},
+	}
+
+	for _, c := range cases {
+		if got := normalizeMaxAttempts(c.maxAttempts); got != c.want {
+			t.Errorf("normalizeMaxAttempts(%d) = %d, want %d", c.maxAttempts, got, c.want)
+		}
+	}
+}
+
+func TestNextBackoffDelay(t *testing.T) {
+	cases := []struct {
+		delay  time.Duration
+		factor float64
+		want   time.Duration
+	}{
+		{delay: time.Second, factor: 2.0, want: 2 * time.Second},
+		{delay: time.Second, factor: 1.0, want: time.Second},
+		{delay: 0, factor: 2.0, want: 0},
+	}
+
+	for _, c := range cases {
+		if got := nextBackoffDelay(c.delay, c.factor); got != c.want {
+			t.Errorf("nextBackoffDelay(%v, %v) = %v, want %v", c.delay, c.factor, got, c.want)
+		}
+	}
+}
+
+func TestEscapeTestcase(t *testing.T) {
+	cases := []struct {
+		testcase string
+		want     string
+	}{
+		{testcase: "plain name", want: "plain name"},
+		{testcase: "it handles (parens)", want: "it handles \\(parens\\)"},
+	}
+
+	for _, c := range cases {
+		if got := escapeTestcase(c.testcase); got != c.want {
+			t.Errorf("escapeTestcase(%q) = %q, want %q", c.testcase, got, c.want)
+		}
+	}
+}
+
+func TestBuildBatsJobsIsDeterministic(t *testing.T) {
+	commandMap := map[string][][]string{
+		"report-c.xml": {{"test2", "c.bats"}, {"test1", "c.bats"}},
+		"report-a.xml": {{"test1", "a.bats"}},
+		"report-b.xml": {{"test1", "b.bats"}},
+	}
+
+	var first []batsJob
+	for i := 0; i < 20; i++ {
+		jobs := buildBatsJobs(commandMap)
+		if first == nil {
+			first = jobs
+			continue
+		}
+
+		if !reflect.DeepEqual(jobs, first) {
+			t.Fatalf("buildBatsJobs returned a different order on run %d: got %+v, want %+v", i, jobs, first)
+		}
+	}
+}
+
+func TestShardJobsAgreeAcrossIndependentRuns(t *testing.T) {
+	commandMap := map[string][][]string{
+		"report-a.xml": {{"test1", "a.bats"}, {"test2", "a.bats"}},
+		"report-b.xml": {{"test1", "b.bats"}},
+		"report-c.xml": {{"test1", "c.bats"}, {"test2", "c.bats"}},
+	}
+
+	const shardTotal = 3
+	seen := map[batsJob]int{}
+	for shardIndex := 0; shardIndex < shardTotal; shardIndex++ {
+		// Rebuild from scratch each time to simulate a separate CI node
+		// process independently re-deriving its job list.
+		jobs := buildBatsJobs(commandMap)
+		for _, job := range shardJobs(jobs, shardIndex, shardTotal) {
+			seen[job]++
+		}
+	}
+
+	all := buildBatsJobs(commandMap)
+	if len(seen) != len(all) {
+		t.Fatalf("sharded jobs cover %d testcases, want %d", len(seen), len(all))
+	}
+
+	for job, count := range seen {
+		if count != 1 {
+			t.Errorf("job %+v was assigned to %d shards, want exactly 1", job, count)
+		}
+	}
+}
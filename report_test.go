@@ -0,0 +1,153 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const junitFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuite name="foo.bats" tests="2" failures="1" errors="0" skipped="0" time="1.000000" timestamp="2026-07-26T00:00:00Z" hostname="localhost">
+  <properties>
+    <property name="BATS_CWD" value="/tmp/tests"></property>
+  </properties>
+  <testcase classname="foo.bats" name="it passes" time="0.500000"></testcase>
+  <testcase classname="foo.bats" name="it fails" time="0.500000">
+    <failure type="failure">expected true, got false</failure>
+  </testcase>
+</testsuite>
+`
+
+func TestJunitReportRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "report.xml")
+	if err := writeReportFile(original, []byte(junitFixture)); err != nil {
+		t.Fatalf("writeReportFile: %v", err)
+	}
+
+	report, err := readJunitFile(original)
+	if err != nil {
+		t.Fatalf("readJunitFile: %v", err)
+	}
+
+	testfile, err := report.Testfile()
+	if err != nil {
+		t.Fatalf("Testfile: %v", err)
+	}
+	if want := filepath.Join("/tmp/tests", "foo.bats"); testfile != want {
+		t.Errorf("Testfile() = %q, want %q", testfile, want)
+	}
+
+	testcases := report.Testcases()
+	if len(testcases) != 2 {
+		t.Fatalf("Testcases() = %d entries, want 2", len(testcases))
+	}
+	if !testcases[1].Failed {
+		t.Errorf("Testcases()[1].Failed = false, want true")
+	}
+
+	report.MarkPassed("it fails", 750*time.Millisecond, 2)
+
+	if r := report.testsuite.Failures; r != "0" {
+		t.Errorf("testsuite.Failures after MarkPassed = %q, want \"0\"", r)
+	}
+	if r := report.testsuite.Tests; r != "2" {
+		t.Errorf("testsuite.Tests after MarkPassed = %q, want \"2\"", r)
+	}
+
+	rewritten := filepath.Join(dir, "rewritten.xml")
+	if err := report.Write(rewritten); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	reread, err := readJunitFile(rewritten)
+	if err != nil {
+		t.Fatalf("readJunitFile (rewritten): %v", err)
+	}
+
+	for _, testcase := range reread.Testcases() {
+		if testcase.Name == "it fails" && testcase.Failed {
+			t.Errorf("testcase %q still marked failed after rewrite", testcase.Name)
+		}
+	}
+	if reread.testsuite.Failures != "0" {
+		t.Errorf("rewritten testsuite.Failures = %q, want \"0\"", reread.testsuite.Failures)
+	}
+}
+
+const batsJSONFixture = `{
+  "file": "/tmp/tests/foo.bats",
+  "tests": 2,
+  "failures": 1,
+  "skipped": 0,
+  "test_cases": [
+    {"name": "it passes", "duration": 0.5, "status": "passed"},
+    {"name": "it fails", "duration": 0.5, "status": "failed"}
+  ]
+}
+`
+
+func TestBatsJSONReportRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "report.json")
+	if err := writeReportFile(original, []byte(batsJSONFixture)); err != nil {
+		t.Fatalf("writeReportFile: %v", err)
+	}
+
+	report, err := readBatsJSONFile(original)
+	if err != nil {
+		t.Fatalf("readBatsJSONFile: %v", err)
+	}
+
+	testfile, err := report.Testfile()
+	if err != nil {
+		t.Fatalf("Testfile: %v", err)
+	}
+	if testfile != "/tmp/tests/foo.bats" {
+		t.Errorf("Testfile() = %q, want /tmp/tests/foo.bats", testfile)
+	}
+
+	report.MarkPassed("it fails", 750*time.Millisecond, 3)
+
+	if report.Failures != 0 {
+		t.Errorf("Failures after MarkPassed = %d, want 0", report.Failures)
+	}
+	if report.Tests != 2 {
+		t.Errorf("Tests after MarkPassed = %d, want 2", report.Tests)
+	}
+
+	rewritten := filepath.Join(dir, "rewritten.json")
+	if err := report.Write(rewritten); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	reread, err := readBatsJSONFile(rewritten)
+	if err != nil {
+		t.Fatalf("readBatsJSONFile (rewritten): %v", err)
+	}
+	if reread.Failures != 0 {
+		t.Errorf("rewritten Failures = %d, want 0", reread.Failures)
+	}
+	for _, testcase := range reread.TestCases {
+		if testcase.Name == "it fails" && testcase.Status != "passed" {
+			t.Errorf("testcase %q status = %q, want passed", testcase.Name, testcase.Status)
+		}
+		if testcase.Name == "it fails" && testcase.RetryAttempts != 3 {
+			t.Errorf("testcase %q RetryAttempts = %d, want 3", testcase.Name, testcase.RetryAttempts)
+		}
+	}
+}
+
+func TestReadTestReportRejectsTAP(t *testing.T) {
+	_, err := readTestReport("tap", "unused")
+	if err == nil {
+		t.Fatal("readTestReport(tap, ...) = nil error, want an error")
+	}
+}
+
+func TestReadTestReportRejectsUnknownFormat(t *testing.T) {
+	_, err := readTestReport("yaml", "unused")
+	if err == nil {
+		t.Fatal("readTestReport(yaml, ...) = nil error, want an error")
+	}
+}
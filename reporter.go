@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Reporter publishes the testcases that failed initially but passed on
+// retry (the actual flakes) to somewhere a team already watches, so the
+// rewritten report doesn't have to be post-processed by hand.
+type Reporter interface {
+	Report(flakes []TestcaseSummary) error
+}
+
+// newReporter builds a Reporter from a --report value of the form
+// scheme://destination (e.g. "slack://hooks.slack.com/services/...",
+// "http://example.com/flakes", "jsonl:///tmp/flakes.jsonl"). "stdout" is
+// accepted bare, with no "://destination" suffix.
+func newReporter(spec string) (Reporter, error) {
+	if spec == "stdout" {
+		return &StdoutReporter{}, nil
+	}
+
+	scheme, rest, ok := strings.Cut(spec, "://")
+	if !ok {
+		return nil, fmt.Errorf("Invalid --report value %q, expected scheme://destination", spec)
+	}
+
+	switch scheme {
+	case "stdout":
+		return &StdoutReporter{}, nil
+	case "jsonl":
+		return &JSONLinesReporter{destination: rest}, nil
+	case "slack":
+		return &SlackReporter{webhookURL: "https://" + rest}, nil
+	case "http", "https":
+		return &HTTPReporter{url: spec}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported --report scheme: %s", scheme)
+	}
+}
+
+// StdoutReporter logs each flake as a human-readable line via the package
+// logger.
+type StdoutReporter struct{}
+
+func (r *StdoutReporter) Report(flakes []TestcaseSummary) error {
+	for _, flake := range flakes {
+		logger.WithField("testfile", flake.Testfile).
+			WithField("testcase", flake.Testcase).
+			WithField("attempts", flake.Attempts).
+			Info("Flaky testcase recovered on retry")
+	}
+
+	return nil
+}
+
+// JSONLinesReporter writes one JSON object per flake, one per line, to a
+// file (or stdout when destination is "" or "-").
+type JSONLinesReporter struct {
+	destination string
+}
+
+func (r *JSONLinesReporter) Report(flakes []TestcaseSummary) error {
+	w := os.Stdout
+	if r.destination != "" && r.destination != "-" {
+		f, err := os.OpenFile(r.destination, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to open json-lines destination: %s", err.Error())
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	for _, flake := range flakes {
+		if err := enc.Encode(flake); err != nil {
+			return fmt.Errorf("Failed to write flake as json: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// SlackReporter posts a human-readable summary of the flakes to a Slack
+// incoming webhook.
+type SlackReporter struct {
+	webhookURL string
+}
+
+func (r *SlackReporter) Report(flakes []TestcaseSummary) error {
+	if len(flakes) == 0 {
+		return nil
+	}
+
+	lines := make([]string, 0, len(flakes))
+	for _, flake := range flakes {
+		lines = append(lines, fmt.Sprintf("- `%s` in %s (%d attempts)", flake.Testcase, flake.Testfile, flake.Attempts))
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("Flaky tests recovered on retry:\n%s", strings.Join(lines, "\n")),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to marshal slack payload: %s", err.Error())
+	}
+
+	return postJSON(r.webhookURL, payload)
+}
+
+// HTTPReporter POSTs the full flake list as a JSON array to an arbitrary
+// endpoint, for teams with their own dashboard ingestion.
+type HTTPReporter struct {
+	url string
+}
+
+func (r *HTTPReporter) Report(flakes []TestcaseSummary) error {
+	payload, err := json.Marshal(flakes)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal flakes: %s", err.Error())
+	}
+
+	return postJSON(r.url, payload)
+}
+
+func postJSON(url string, payload []byte) error {
+	resp, err := http.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Failed to post report to %s: %s", url, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Report endpoint %s returned status %d", url, resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewReporter(t *testing.T) {
+	cases := []struct {
+		spec        string
+		wantType    Reporter
+		expectError bool
+	}{
+		{spec: "stdout", wantType: &StdoutReporter{}},
+		{spec: "stdout://", wantType: &StdoutReporter{}},
+		{spec: "jsonl:///tmp/flakes.jsonl", wantType: &JSONLinesReporter{}},
+		{spec: "slack://hooks.slack.com/services/x", wantType: &SlackReporter{}},
+		{spec: "http://example.com/flakes", wantType: &HTTPReporter{}},
+		{spec: "https://example.com/flakes", wantType: &HTTPReporter{}},
+		{spec: "carrierpigeon://example.com", expectError: true},
+		{spec: "no-scheme-separator", expectError: true},
+	}
+
+	for _, c := range cases {
+		reporter, err := newReporter(c.spec)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("newReporter(%q): expected error, got none", c.spec)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("newReporter(%q): unexpected error: %s", c.spec, err)
+			continue
+		}
+
+		gotType := reflectTypeName(reporter)
+		wantType := reflectTypeName(c.wantType)
+		if gotType != wantType {
+			t.Errorf("newReporter(%q) = %s, want %s", c.spec, gotType, wantType)
+		}
+	}
+}
+
+func reflectTypeName(r Reporter) string {
+	switch r.(type) {
+	case *StdoutReporter:
+		return "StdoutReporter"
+	case *JSONLinesReporter:
+		return "JSONLinesReporter"
+	case *SlackReporter:
+		return "SlackReporter"
+	case *HTTPReporter:
+		return "HTTPReporter"
+	default:
+		return "unknown"
+	}
+}
+
+func TestNewReporterSlackPrependsHTTPS(t *testing.T) {
+	reporter, err := newReporter("slack://hooks.slack.com/services/x")
+	if err != nil {
+		t.Fatalf("newReporter: %v", err)
+	}
+
+	slack, ok := reporter.(*SlackReporter)
+	if !ok {
+		t.Fatalf("newReporter returned %T, want *SlackReporter", reporter)
+	}
+	if want := "https://hooks.slack.com/services/x"; slack.webhookURL != want {
+		t.Errorf("webhookURL = %q, want %q", slack.webhookURL, want)
+	}
+}
+
+func TestJSONLinesReporterWritesToFile(t *testing.T) {
+	dir := t.TempDir()
+	destination := filepath.Join(dir, "flakes.jsonl")
+
+	reporter := &JSONLinesReporter{destination: destination}
+	flakes := []TestcaseSummary{
+		{Testfile: "a.bats", Testcase: "t1", Attempts: 2},
+		{Testfile: "b.bats", Testcase: "t2", Attempts: 3},
+	}
+
+	if err := reporter.Report(flakes); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+
+	contents, err := os.ReadFile(destination)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+
+	var first TestcaseSummary
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if first.Testcase != "t1" {
+		t.Errorf("first.Testcase = %q, want t1", first.Testcase)
+	}
+}
+
+func TestHTTPReporterPostsPayload(t *testing.T) {
+	var gotPath string
+	var gotBody []TestcaseSummary
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		json.Unmarshal(body.Bytes(), &gotBody)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	reporter := &HTTPReporter{url: server.URL + "/flakes"}
+	flakes := []TestcaseSummary{{Testfile: "a.bats", Testcase: "t1", Attempts: 1}}
+
+	if err := reporter.Report(flakes); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+
+	if gotPath != "/flakes" {
+		t.Errorf("server received path %q, want /flakes", gotPath)
+	}
+	if len(gotBody) != 1 || gotBody[0].Testcase != "t1" {
+		t.Errorf("server received body %+v, want one flake named t1", gotBody)
+	}
+}
+
+func TestHTTPReporterReturnsErrorOnNon2xx(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	reporter := &HTTPReporter{url: server.URL}
+	if err := reporter.Report([]TestcaseSummary{{Testcase: "t1"}}); err == nil {
+		t.Fatal("Report: expected error on 500 response, got nil")
+	}
+}
+
+func TestSlackReporterSkipsEmptyFlakes(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	reporter := &SlackReporter{webhookURL: server.URL}
+	if err := reporter.Report(nil); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	if called {
+		t.Error("Report posted to the webhook for an empty flake list")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// jobResult records how a single retried testcase fared, for the run
+// summary written via --summary-json.
+type jobResult struct {
+	testfile  string
+	testcase  string
+	attempts  int
+	duration  time.Duration
+	recovered bool
+}
+
+// TestcaseSummary is the per-testcase entry in a RetrySummary.
+type TestcaseSummary struct {
+	Testfile  string  `json:"testfile"`
+	Testcase  string  `json:"testcase"`
+	Attempts  int     `json:"attempts"`
+	Duration  float64 `json:"duration"`
+	Recovered bool    `json:"recovered"`
+}
+
+// RetrySummary is the machine-readable summary of a retry run, suitable for
+// uploading to a CI dashboard alongside the merged test report.
+type RetrySummary struct {
+	InitiallyFailed int               `json:"initially_failed"`
+	Retried         int               `json:"retried"`
+	Recovered       int               `json:"recovered"`
+	StillFailing    int               `json:"still_failing"`
+	Testcases       []TestcaseSummary `json:"testcases"`
+}
+
+// buildSummary tallies the outcome of every retried testcase in results.
+func buildSummary(results []jobResult) RetrySummary {
+	summary := RetrySummary{
+		InitiallyFailed: len(results),
+		Testcases:       make([]TestcaseSummary, 0, len(results)),
+	}
+
+	for _, result := range results {
+		if result.attempts > 1 {
+			summary.Retried++
+		}
+
+		if result.recovered {
+			summary.Recovered++
+		} else {
+			summary.StillFailing++
+		}
+
+		summary.Testcases = append(summary.Testcases, TestcaseSummary{
+			Testfile:  result.testfile,
+			Testcase:  result.testcase,
+			Attempts:  result.attempts,
+			Duration:  result.duration.Seconds(),
+			Recovered: result.recovered,
+		})
+	}
+
+	return summary
+}
+
+func writeSummaryJSON(filename string, summary RetrySummary) error {
+	b, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeReportFile(filename, b)
+}
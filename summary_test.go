@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildSummary(t *testing.T) {
+	results := []jobResult{
+		{testfile: "a.bats", testcase: "t1", attempts: 1, duration: time.Second, recovered: true},
+		{testfile: "a.bats", testcase: "t2", attempts: 3, duration: 2 * time.Second, recovered: true},
+		{testfile: "b.bats", testcase: "t3", attempts: 2, duration: time.Second, recovered: false},
+	}
+
+	summary := buildSummary(results)
+
+	if summary.InitiallyFailed != 3 {
+		t.Errorf("InitiallyFailed = %d, want 3", summary.InitiallyFailed)
+	}
+	if summary.Retried != 2 {
+		t.Errorf("Retried = %d, want 2", summary.Retried)
+	}
+	if summary.Recovered != 2 {
+		t.Errorf("Recovered = %d, want 2", summary.Recovered)
+	}
+	if summary.StillFailing != 1 {
+		t.Errorf("StillFailing = %d, want 1", summary.StillFailing)
+	}
+	if len(summary.Testcases) != 3 {
+		t.Fatalf("Testcases = %d entries, want 3", len(summary.Testcases))
+	}
+	if summary.Testcases[1].Testcase != "t2" || summary.Testcases[1].Attempts != 3 {
+		t.Errorf("Testcases[1] = %+v, want testcase t2 with 3 attempts", summary.Testcases[1])
+	}
+}
+
+func TestBuildSummaryEmpty(t *testing.T) {
+	summary := buildSummary(nil)
+
+	if summary.InitiallyFailed != 0 || summary.Retried != 0 || summary.Recovered != 0 || summary.StillFailing != 0 {
+		t.Errorf("buildSummary(nil) = %+v, want all-zero summary", summary)
+	}
+	if len(summary.Testcases) != 0 {
+		t.Errorf("buildSummary(nil).Testcases = %v, want empty", summary.Testcases)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path"
+	"runtime"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+)
+
+// runWatch implements `bats-retry watch testDirectory`: an interactive TDD
+// loop that re-runs only the currently-failing testcases (discovered from
+// the latest report in testDirectory) whenever the test directory or one of
+// the bats files it references changes on disk.
+func runWatch(argv []string) {
+	args := flag.NewFlagSet("bats-retry watch", flag.ExitOnError)
+	var formatFlag *string = args.String("format", string(FormatJunit), "test report format to read: junit, json")
+	var parallel *int = args.IntP("parallel", "p", runtime.NumCPU(), "number of bats commands to run concurrently")
+	var maxAttempts *int = args.Int("max-attempts", 1, "number of times to attempt a failing testcase before giving up")
+	var backoff *time.Duration = args.Duration("backoff", time.Second, "initial delay between retry attempts")
+	var backoffFactor *float64 = args.Float64("backoff-factor", 2.0, "multiplier applied to --backoff after each attempt")
+	var timeout *time.Duration = args.Duration("timeout", 0, "kill a bats invocation if it runs longer than this (0 disables)")
+
+	args.Parse(argv)
+	testDirectory := args.Arg(0)
+
+	format := ReportFormat(*formatFlag)
+	if format != FormatJunit && format != FormatJSON {
+		logger.WithField("format", *formatFlag).Error("Unsupported report format")
+		os.Exit(1)
+	}
+
+	if testDirectory == "" {
+		logger.Error("No test directory specified")
+		os.Exit(1)
+	}
+
+	retry := retryConfig{
+		maxAttempts:   *maxAttempts,
+		backoff:       *backoff,
+		backoffFactor: *backoffFactor,
+		timeout:       *timeout,
+	}
+
+	l := logger.WithField("test-directory", testDirectory)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		l.WithField("error", err.Error()).Error("Error creating watcher")
+		os.Exit(1)
+	}
+	defer watcher.Close()
+
+	if err := watchTestFiles(watcher, testDirectory, format, l); err != nil {
+		l.WithField("error", err.Error()).Error("Error watching test directory")
+		os.Exit(1)
+	}
+
+	l.Info("Watching for changes")
+	runFailingTestcases(testDirectory, format, *parallel, retry, l)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			l.WithField("file", event.Name).Info("Change detected, re-running failing testcases")
+			runFailingTestcases(testDirectory, format, *parallel, retry, l)
+
+			if err := watchTestFiles(watcher, testDirectory, format, l); err != nil {
+				l.WithField("error", err.Error()).Warn("Error refreshing watch targets")
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+
+			l.WithField("error", err.Error()).Error("Watcher error")
+		}
+	}
+}
+
+// watchTestFiles adds testDirectory, and the directory of every bats test
+// file referenced by the reports in it (i.e. BATS_CWD), to watcher.
+func watchTestFiles(watcher *fsnotify.Watcher, testDirectory string, format ReportFormat, logger *logrus.Entry) error {
+	watchDirs := map[string]bool{testDirectory: true}
+
+	validFiles, err := listReportFiles(testDirectory, format)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range validFiles {
+		report, err := readTestReport(format, path.Join(testDirectory, file.Name()))
+		if err != nil {
+			continue
+		}
+
+		testfile, err := report.Testfile()
+		if err != nil {
+			continue
+		}
+
+		watchDirs[path.Dir(testfile)] = true
+	}
+
+	for dir := range watchDirs {
+		if err := watcher.Add(dir); err != nil {
+			logger.WithField("dir", dir).WithField("error", err.Error()).Warn("Unable to watch directory")
+		}
+	}
+
+	return nil
+}
+
+// runFailingTestcases re-derives the currently-failing testcases from the
+// latest reports in testDirectory and retries them through the same
+// executeBatsCommands path `--execute` uses.
+func runFailingTestcases(testDirectory string, format ReportFormat, parallel int, retry retryConfig, logger *logrus.Entry) {
+	validFiles, err := listReportFiles(testDirectory, format)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error reading test directory")
+		return
+	}
+
+	if len(validFiles) == 0 {
+		logger.Info("No testsuites found")
+		return
+	}
+
+	batsCommands, err := collectFailingCommands(testDirectory, validFiles, format, logger)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Error processing file")
+		return
+	}
+
+	if len(batsCommands) == 0 {
+		logger.Info("No failing testcases")
+		return
+	}
+
+	if _, err := executeBatsCommands(batsCommands, testDirectory, format, parallel, retry, logger); err != nil {
+		logger.WithField("error", err.Error()).Error("Error executing bats commands")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestWatchTestFilesWatchesReportAndBatsDirs(t *testing.T) {
+	testDirectory := t.TempDir()
+	batsDir := t.TempDir()
+
+	report := BatsJSONReport{
+		File:  filepath.Join(batsDir, "foo.bats"),
+		Tests: 1,
+		TestCases: []BatsJSONTestcase{
+			{Name: "it fails", Status: "failed"},
+		},
+	}
+	b, err := os.ReadFile(writeReportFixture(t, testDirectory, "report.json", report))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(b) == 0 {
+		t.Fatal("report fixture is empty")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatalf("fsnotify.NewWatcher: %v", err)
+	}
+	defer watcher.Close()
+
+	l := logger.WithField("test", "watch")
+	if err := watchTestFiles(watcher, testDirectory, FormatJSON, l); err != nil {
+		t.Fatalf("watchTestFiles: %v", err)
+	}
+
+	watched := map[string]bool{}
+	for _, dir := range watcher.WatchList() {
+		watched[dir] = true
+	}
+
+	if !watched[testDirectory] {
+		t.Errorf("watchTestFiles did not watch testDirectory %q; watched: %v", testDirectory, watched)
+	}
+	if !watched[batsDir] {
+		t.Errorf("watchTestFiles did not watch the bats file's directory %q; watched: %v", batsDir, watched)
+	}
+}
+
+// writeReportFixture marshals report as JSON into dir/name and returns the
+// path, failing the test on error.
+func writeReportFixture(t *testing.T, dir string, name string, report BatsJSONReport) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := (&report).Write(path); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	return path
+}